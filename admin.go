@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// startAdminServer serves /metrics, /healthz and /readyz on a separate
+// admin port, so scraping and health checks aren't multiplexed with the
+// traffic-collection listener. It blocks until ctx is cancelled, or returns
+// early if the listener fails (e.g. the port is already in use).
+func startAdminServer(ctx context.Context, addr string, logger logrus.FieldLogger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logger.Infof("admin server (metrics/health) listening at %s..", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Warnf("admin server stopped: %v", err)
+	}
+}
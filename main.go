@@ -1,12 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,13 +16,25 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	serviceName = "traffic-collector"
-	maxRequests = 1000
+	serviceName          = "traffic-collector"
+	maxRequests          = 1000
+	defaultChannelBuffer = 100
+
+	// shutdownFlushTimeout bounds the final drain flush on shutdown. It
+	// deliberately does not derive from the cancelled shutdown context —
+	// see drain().
+	shutdownFlushTimeout = 10 * time.Second
+
+	// flushRetryBackoff bounds how often flush() will retry Storage.Put
+	// after a failure, so a storage outage doesn't turn every subsequent
+	// append into another doomed upload attempt.
+	flushRetryBackoff = 30 * time.Second
 )
 
 type Environment struct {
@@ -33,32 +42,106 @@ type Environment struct {
 	Filename string `env:"FILENAME"`
 	S3Bucket string `env:"S3_BUCKET"`
 	Port     string `env:"PORT"`
+
+	// replay mode: consume previously captured request bundles from S3,
+	// either via SQS object-created notifications or plain bucket polling.
+	SQSQueueURL        string `env:"SQS_QUEUE_URL"`
+	AWSRegion          string `env:"AWS_REGION"`
+	PollingIntervalSec int    `env:"POLLING_INTERVAL"`
+	PollBucket         string `env:"POLL_BUCKET"`
+	PollPrefix         string `env:"POLL_PREFIX"`
+	ReplayUpstreamURL  string `env:"REPLAY_UPSTREAM_URL"`
+
+	// storage backend selection, see storage.go
+	StorageBackend string `env:"STORAGE_BACKEND"`
+	FileDir        string `env:"FILE_DIR"`
+
+	AWSS3Endpoint       string `env:"AWS_S3_ENDPOINT"`
+	AWSS3Region         string `env:"AWS_S3_REGION"`
+	AWSS3AccessKey      string `env:"AWS_S3_ACCESSKEY"`
+	AWSS3SecretKey      string `env:"AWS_S3_SECRETKEY"`
+	AWSS3ForcePathStyle bool   `env:"AWS_S3_FORCE_PATH_STYLE"`
+
+	// s3 streaming uploader tuning, see storage_s3.go
+	S3PartSizeMB         int `env:"S3_PART_SIZE_MB"`
+	S3UploadConcurrency  int `env:"S3_UPLOAD_CONCURRENCY"`
+	S3MaxRetries         int `env:"S3_MAX_RETRIES"`
+	S3MaxInflightUploads int `env:"S3_MAX_INFLIGHT_UPLOADS"`
+
+	// s3 per-object knobs
+	S3ACL          string `env:"S3_ACL"`
+	S3SSE          string `env:"S3_SSE"`
+	S3SSEKMSKeyID  string `env:"S3_SSE_KMS_KEY_ID"`
+	S3StorageClass string `env:"S3_STORAGE_CLASS"`
+
+	GCSBucket          string `env:"GCS_BUCKET"`
+	GCSCredentialsFile string `env:"GCS_CREDENTIALS_FILE"`
+	GCSStorageClass    string `env:"GCS_STORAGE_CLASS"`
+	GCSKMSKeyName      string `env:"GCS_KMS_KEY_NAME"`
+
+	AzureAccount      string `env:"AZURE_STORAGE_ACCOUNT"`
+	AzureKey          string `env:"AZURE_STORAGE_KEY"`
+	AzureContainer    string `env:"AZURE_STORAGE_CONTAINER"`
+	AzureAccessTier   string `env:"AZURE_ACCESS_TIER"`
+	AzureBufferSizeMB int    `env:"AZURE_BUFFER_SIZE_MB"`
+	AzureMaxBuffers   int    `env:"AZURE_MAX_BUFFERS"`
+
+	// rolling writer: flush on whichever of these triggers first.
+	OutputFormat     string `env:"OUTPUT_FORMAT"`
+	RollMaxRequests  int    `env:"ROLL_MAX_REQUESTS"`
+	RollMaxBytes     int64  `env:"ROLL_MAX_BYTES"`
+	RollIntervalSecs int    `env:"ROLL_INTERVAL"`
+
+	// reverse-proxy mode: forward each request upstream and record the
+	// paired request/response Interaction instead of a bare Request.
+	UpstreamURL  string `env:"UPSTREAM_URL"`
+	MaxBodyBytes int64  `env:"MAX_BODY_BYTES"`
+
+	// observability: metrics/health on a separate admin port, and a
+	// bounded collection buffer so a slow flush can't OOM the process.
+	AdminPort     string `env:"ADMIN_PORT"`
+	ChannelBuffer int    `env:"CHANNEL_BUFFER"`
 }
 
 type Collector struct {
-	S3Bucket string
 	Timeout  int
 	Filename string
 	Logger   logrus.FieldLogger
 
-	// create a buffer channel
-	processedRequestData chan Request
-	RequestDataList      []Request
+	// create a buffer channel. Each item is either a Request (the
+	// default, log-only mode) or an Interaction (reverse-proxy mode).
+	processedRequestData chan interface{}
+	RequestDataList      []interface{}
+	bufferedBytes        int64
 	reqDataWaitGroup     sync.WaitGroup
 
-	// s3 stuff
-	Context   context.Context
-	S3Session *s3.S3
+	// nextFlushAttempt gates retries after a failed flush; see flush().
+	nextFlushAttempt time.Time
+
+	// rolling writer triggers, see rolling.go
+	OutputFormat    OutputFormat
+	RollMaxRequests int
+	RollMaxBytes    int64
+	RollInterval    time.Duration
+
+	// reverse-proxy mode, see proxy.go
+	UpstreamURL  string
+	MaxBodyBytes int64
+	proxyClient  *http.Client
+
+	Storage        Storage
+	StorageBackend string
 }
 
 // Request represents an HTTP request
 type Request struct {
-	Header http.Header `json:"headers"`
-	Body   string      `json:"body"`
-	Method string      `json:"method"`
-	Path   string      `json:"path"`
-	Query  url.Values  `json:"query"`
-	Host   string      `json:"host"`
+	Header    http.Header `json:"headers"`
+	Body      string      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Query     url.Values  `json:"query"`
+	Host      string      `json:"host"`
 }
 
 func (c *Collector) ServeHTTP(wr http.ResponseWriter, r *http.Request) {
@@ -74,82 +157,217 @@ func (c *Collector) ServeHTTP(wr http.ResponseWriter, r *http.Request) {
 	reqdata.Query = r.URL.Query()
 	reqdata.Host = r.Host
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		c.Logger.Fatal(errors.Wrap(err, "reading body"))
+	requestsReceivedTotal.Inc()
+
+	if c.UpstreamURL != "" {
+		// proxyAndRecord reads r.Body itself, teeing the full, untruncated
+		// body upstream while capping what gets recorded.
+		c.proxyAndRecord(wr, r, reqdata)
+		return
+	}
+
+	captured := &cappedBuffer{max: c.MaxBodyBytes}
+	if _, err := io.Copy(captured, r.Body); err != nil {
+		c.Logger.Warn(errors.Wrap(err, "reading body"))
+		http.Error(wr, "error reading request body", http.StatusBadRequest)
+		return
 	}
-	reqdata.Body = string(body)
+	reqdata.Body = captured.String()
+	reqdata.Truncated = captured.truncated
 
-	c.processedRequestData <- reqdata
+	c.enqueue(reqdata)
 }
 
-func (c *Collector) collectRequests() {
-	for d := range c.processedRequestData {
-		c.RequestDataList = append(c.RequestDataList, d)
+// enqueue pushes an item onto processedRequestData without blocking the
+// caller: if the buffer is full, the item is dropped and accounted for
+// in requests_dropped_total rather than applying backpressure to the
+// HTTP handler.
+func (c *Collector) enqueue(item interface{}) {
+	select {
+	case c.processedRequestData <- item:
+	default:
+		requestsDroppedTotal.Inc()
+		c.Logger.Warn("dropping item: collection buffer is full")
+	}
+}
 
-		if len(c.RequestDataList) >= maxRequests {
-			c.writeRequestsToFile()
+// collectRequests buffers incoming requests until one of the rolling
+// triggers (count, byte size, or wall-clock interval) fires, then flushes
+// the batch to Storage. It drains whatever is still buffered in
+// processedRequestData before returning when ctx is cancelled, so a
+// shutdown doesn't drop in-flight requests.
+func (c *Collector) collectRequests(ctx context.Context) {
+	defer c.reqDataWaitGroup.Done()
+
+	var tickerC <-chan time.Time
+	if c.RollInterval > 0 {
+		ticker := time.NewTicker(c.RollInterval)
+		defer ticker.Stop()
+		tickerC = ticker.C
+	}
+
+	for {
+		select {
+		case d, ok := <-c.processedRequestData:
+			if !ok {
+				if err := c.flush(ctx); err != nil {
+					c.Logger.Warn(errors.Wrap(err, "flushing on channel close"))
+				}
+				return
+			}
+			c.appendRequest(ctx, d)
+
+		case <-tickerC:
+			if len(c.RequestDataList) > 0 {
+				if err := c.flush(ctx); err != nil {
+					c.Logger.Warn(errors.Wrap(err, "flushing on roll interval"))
+				}
+			}
+
+		case <-ctx.Done():
+			c.drain()
+			return
 		}
 	}
 }
 
-func (c *Collector) writeRequestsToFile() error {
-	time := time.Now()
-	jsonData, err := json.MarshalIndent(c.RequestDataList, "", " ")
-	if err != nil {
-		return errors.Wrap(err, "marshaling request data")
-	}
-
-	if c.S3Bucket != "" {
-		// write to s3 bucket
-		key := fmt.Sprintf("%s/%s.json",
-			time.Format("20060102"),
-			time.Format("150405"),
-		)
-		_, err := c.S3Session.PutObjectWithContext(
-			c.Context,
-			&s3.PutObjectInput{
-				ACL:         aws.String("private"),
-				Bucket:      aws.String(c.S3Bucket),
-				Body:        bytes.NewReader(jsonData),
-				ContentType: aws.String("application/json"),
-				Key:         aws.String(key),
-			},
-		)
-		if err != nil {
-			return errors.Wrap(err, "s3 put object")
-		}
-	} else {
-		fileName := fmt.Sprintf("%s_%s.json", c.Filename, time.Format("150405"))
-		c.Logger.Infof("writing to file: %s ", fileName)
+func (c *Collector) appendRequest(ctx context.Context, d interface{}) {
+	c.RequestDataList = append(c.RequestDataList, d)
+	c.bufferedBytes += approxSize(d)
+	bufferDepth.Set(float64(len(c.RequestDataList)))
 
-		f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
-		if err != nil {
-			return errors.Wrap(err, "opening file")
+	rollMax := c.RollMaxRequests
+	if rollMax <= 0 {
+		rollMax = defaultRollMax
+	}
+
+	if len(c.RequestDataList) >= rollMax || (c.RollMaxBytes > 0 && c.bufferedBytes >= c.RollMaxBytes) {
+		if err := c.flush(ctx); err != nil {
+			c.Logger.Warn(errors.Wrap(err, "flushing on roll threshold"))
 		}
+	}
+}
 
-		_, err = io.WriteString(f, string(jsonData))
-		if err != nil {
-			return errors.Wrap(err, "writing to file")
+// drain empties whatever is still sitting in processedRequestData without
+// blocking, then flushes the remainder. It only runs after the collector's
+// operating context has already been cancelled (see collectRequests), so it
+// uses its own short-lived context for the flush(es) below instead of that
+// cancelled one — otherwise Storage.Put would fail immediately against every
+// non-file backend and silently drop the exact batch this step exists to
+// protect.
+func (c *Collector) drain() {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case d, ok := <-c.processedRequestData:
+			if !ok {
+				// Last chance to write: don't let a pending retry backoff
+				// turn this flush into a silent no-op.
+				c.nextFlushAttempt = time.Time{}
+				if err := c.flush(shutdownCtx); err != nil {
+					c.Logger.Warn(errors.Wrap(err, "flushing on shutdown"))
+				}
+				return
+			}
+			c.appendRequest(shutdownCtx, d)
+		default:
+			c.nextFlushAttempt = time.Time{}
+			if err := c.flush(shutdownCtx); err != nil {
+				c.Logger.Warn(errors.Wrap(err, "flushing on shutdown"))
+			}
+			return
 		}
 	}
+}
+
+func (c *Collector) flush(ctx context.Context) error {
+	if len(c.RequestDataList) == 0 {
+		return nil
+	}
+
+	// A prior Storage.Put failed recently: skip this attempt rather than
+	// re-marshaling/re-uploading the same (still-growing) batch on every
+	// single append for as long as the backend is down.
+	if time.Now().Before(c.nextFlushAttempt) {
+		return nil
+	}
+
+	requests := c.RequestDataList
+	key := hivePartitionedKey(time.Now(), c.OutputFormat)
+	c.Logger.Infof("writing %d requests to %s", len(requests), key)
+
+	var opts []PutOption
+	if encoding := contentEncodingFor(c.OutputFormat); encoding != "" {
+		opts = append(opts, WithContentEncoding(encoding))
+	}
+
+	// Stream the encoded batch through a pipe instead of buffering it,
+	// so for the NDJSON formats Storage.Put (and the s3 driver's multipart
+	// uploader) can start reading before the whole batch has been marshaled.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(streamEncode(c.OutputFormat, requests, pw))
+	}()
+
+	counted := &countingReader{r: pr}
+	if err := c.Storage.Put(ctx, key, counted, contentTypeFor(c.OutputFormat), opts...); err != nil {
+		c.nextFlushAttempt = time.Now().Add(flushRetryBackoff)
+		return errors.Wrap(err, "writing request data to storage")
+	}
+
+	c.nextFlushAttempt = time.Time{}
+	batchFlushesTotal.Inc()
+	bytesWrittenTotal.WithLabelValues(c.StorageBackend).Add(float64(counted.n))
+	bufferDepth.Set(0)
 
 	c.RequestDataList = nil
+	c.bufferedBytes = 0
 	return nil
 }
 
+// countingReader tallies bytes as they're read, so flush() can report
+// bytes_written_total without needing the encoded size up front.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func initEnvironment(logger logrus.FieldLogger) Environment {
 	defaultEnvironment := Environment{
-		Timeout:  5,
-		Filename: "sample_data",
-		Port:     "8081",
-		S3Bucket: "",
+		Timeout:            5,
+		Filename:           "sample_data",
+		Port:               "8081",
+		S3Bucket:           "",
+		PollingIntervalSec: 30,
+		OutputFormat:       string(FormatJSON),
+		RollMaxRequests:    maxRequests,
+		MaxBodyBytes:       defaultMaxBodyBytes,
+		AdminPort:          "9090",
+		ChannelBuffer:      defaultChannelBuffer,
+		S3ACL:              "private",
 	}
 
 	_, err := env.UnmarshalFromEnviron(&defaultEnvironment)
 	if err != nil {
 		logger.Fatal(errors.Wrap(err, "unmarshaling environ"))
 	}
+
+	if defaultEnvironment.StorageBackend == "" {
+		if defaultEnvironment.S3Bucket != "" {
+			defaultEnvironment.StorageBackend = "s3"
+		} else {
+			defaultEnvironment.StorageBackend = "file"
+		}
+	}
+
 	return defaultEnvironment
 }
 
@@ -157,23 +375,56 @@ func main() {
 	logger := logrus.WithField("service", serviceName)
 	env := initEnvironment(logger)
 
-	awsSession := session.Must(session.NewSession())
 	cfg := aws.NewConfig()
+	if env.AWSRegion != "" {
+		cfg = cfg.WithRegion(env.AWSRegion)
+	}
+	awsSession := session.Must(session.NewSession(cfg))
 	s3Service := s3.New(awsSession, cfg)
 
-	ctx := context.Background()
+	storage, err := NewStorage(env, logger)
+	if err != nil {
+		logger.Fatal(errors.Wrap(err, "initializing storage backend"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	collector := &Collector{
-		S3Bucket:             env.S3Bucket,
 		Filename:             env.Filename,
-		processedRequestData: make(chan Request),
-		RequestDataList:      make([]Request, 0, maxRequests),
+		processedRequestData: make(chan interface{}, env.ChannelBuffer),
+		RequestDataList:      make([]interface{}, 0, maxRequests),
 		Logger:               logger,
-		S3Session:            s3Service,
-		Context:              ctx,
+		Storage:              storage,
+		StorageBackend:       env.StorageBackend,
+		OutputFormat:         OutputFormat(env.OutputFormat),
+		RollMaxRequests:      env.RollMaxRequests,
+		RollMaxBytes:         env.RollMaxBytes,
+		RollInterval:         time.Duration(env.RollIntervalSecs) * time.Second,
+		UpstreamURL:          env.UpstreamURL,
+		MaxBodyBytes:         env.MaxBodyBytes,
+		proxyClient:          &http.Client{},
 	}
 
 	collector.reqDataWaitGroup.Add(1)
-	go collector.collectRequests()
+	go collector.collectRequests(ctx)
+
+	if env.AdminPort != "" {
+		go startAdminServer(ctx, fmt.Sprintf(":%s", env.AdminPort), logger)
+	}
+
+	if env.SQSQueueURL != "" || env.PollBucket != "" {
+		replayWorker := &ReplayWorker{
+			Collector:       collector,
+			Logger:          logger,
+			SQSClient:       sqs.New(awsSession, cfg),
+			S3Client:        s3Service,
+			QueueURL:        env.SQSQueueURL,
+			PollBucket:      env.PollBucket,
+			PollPrefix:      env.PollPrefix,
+			PollingInterval: time.Duration(env.PollingIntervalSec) * time.Second,
+			UpstreamURL:     env.ReplayUpstreamURL,
+		}
+		go replayWorker.Run(ctx)
+	}
 
 	osChannel := make(chan os.Signal, 1)
 	signal.Notify(osChannel, os.Interrupt)
@@ -184,14 +435,13 @@ func main() {
 	go func() {
 		oscall := <-osChannel
 		logger.Printf("received system call:%+v..", oscall)
-
-		logger.Printf("remaining items in buffer %d..", len(collector.RequestDataList))
-		if len(collector.RequestDataList) > 0 {
-			collector.writeRequestsToFile()
-		}
-
 		defer wg.Done()
-		defer collector.reqDataWaitGroup.Done()
+
+		// cancel tells collectRequests to drain processedRequestData and
+		// flush whatever is buffered; wait for it to actually finish
+		// before exiting so a shutdown can't drop in-flight requests.
+		cancel()
+		collector.reqDataWaitGroup.Wait()
 		os.Exit(0)
 	}()
 
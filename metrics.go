@@ -0,0 +1,52 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	requestsReceivedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_requests_received_total",
+		Help: "Number of requests received by the collector's HTTP listener.",
+	})
+	requestsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_requests_dropped_total",
+		Help: "Number of requests dropped because the collection buffer was full.",
+	})
+	batchFlushesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_batch_flushes_total",
+		Help: "Number of batches flushed to the storage backend.",
+	})
+	bytesWrittenTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "traffic_collector_bytes_written_total",
+		Help: "Bytes written to storage, labeled by destination backend.",
+	}, []string{"backend"})
+	bufferDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "traffic_collector_buffer_depth",
+		Help: "Number of requests currently buffered awaiting flush.",
+	})
+	s3PutLatencySeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "traffic_collector_s3_put_latency_seconds",
+		Help:    "Latency of S3 put/multipart-upload operations.",
+		Buckets: prometheus.DefBuckets,
+	})
+	s3ErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "traffic_collector_s3_errors_total",
+		Help: "S3 errors, labeled by AWS error code.",
+	}, []string{"code"})
+	fileWriteErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_file_write_errors_total",
+		Help: "Errors writing captured traffic to the local filesystem.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsReceivedTotal,
+		requestsDroppedTotal,
+		batchFlushesTotal,
+		bytesWrittenTotal,
+		bufferDepth,
+		s3PutLatencySeconds,
+		s3ErrorsTotal,
+		fileWriteErrorsTotal,
+	)
+}
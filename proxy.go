@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultMaxBodyBytes = 1 << 20 // 1MiB
+
+// Response is the upstream side of a recorded Interaction.
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	Truncated  bool        `json:"truncated,omitempty"`
+}
+
+// Interaction pairs a captured Request with the Response the upstream
+// returned for it, recorded when the collector is running in
+// reverse-proxy mode (UPSTREAM_URL set).
+type Interaction struct {
+	Request    Request   `json:"request"`
+	Response   Response  `json:"response"`
+	DurationMs int64     `json:"duration_ms"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// proxyAndRecord forwards r to c.UpstreamURL, streams the upstream
+// response back to wr, and pushes the resulting Interaction through the
+// normal collection pipeline. reqdata is the Request partially captured by
+// ServeHTTP (headers/method/path/etc, but not yet the body); the request
+// body is read here and teed so the full, untruncated bytes still go
+// upstream while only a capped copy is recorded.
+func (c *Collector) proxyAndRecord(wr http.ResponseWriter, r *http.Request, reqdata Request) {
+	upstreamURL := strings.TrimRight(c.UpstreamURL, "/") + r.URL.Path
+	if r.URL.RawQuery != "" {
+		upstreamURL += "?" + r.URL.RawQuery
+	}
+
+	reqCaptured := &cappedBuffer{max: c.MaxBodyBytes}
+	outreq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, io.TeeReader(r.Body, reqCaptured))
+	if err != nil {
+		c.Logger.Warn(errors.Wrap(err, "building upstream request"))
+		http.Error(wr, "bad upstream request", http.StatusBadGateway)
+		return
+	}
+	outreq.ContentLength = r.ContentLength
+	for k, v := range r.Header {
+		outreq.Header[k] = v
+	}
+
+	started := time.Now()
+	resp, err := c.proxyClient.Do(outreq)
+	if err != nil {
+		c.Logger.Warn(errors.Wrap(err, "forwarding request upstream"))
+		http.Error(wr, "upstream request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// proxyClient.Do has now fully read outreq's body, so reqCaptured holds
+	// the (possibly capped) request body to record.
+	reqdata.Body = reqCaptured.String()
+	reqdata.Truncated = reqCaptured.truncated
+
+	for k, v := range resp.Header {
+		wr.Header()[k] = v
+	}
+	wr.WriteHeader(resp.StatusCode)
+
+	captured := &cappedBuffer{max: c.MaxBodyBytes}
+	if _, err := io.Copy(wr, io.TeeReader(resp.Body, captured)); err != nil {
+		c.Logger.Warn(errors.Wrap(err, "streaming upstream response to client"))
+	}
+	duration := time.Since(started)
+
+	c.enqueue(Interaction{
+		Request: reqdata,
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       captured.String(),
+			Truncated:  captured.truncated,
+		},
+		DurationMs: duration.Milliseconds(),
+		StartedAt:  started,
+	})
+}
+
+// cappedBuffer is an io.Writer that keeps at most max bytes, flagging
+// Truncated once it has discarded anything past that. It never returns an
+// error, so it's safe to use as the sink half of an io.TeeReader without
+// aborting the real copy to the client.
+type cappedBuffer struct {
+	data      []byte
+	max       int64
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if int64(len(b.data)) < b.max {
+		remaining := b.max - int64(len(b.data))
+		if int64(len(p)) > remaining {
+			b.data = append(b.data, p[:remaining]...)
+			b.truncated = true
+		} else {
+			b.data = append(b.data, p...)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return string(b.data)
+}
+
+// approxSize estimates how many bytes an item contributes toward the
+// ROLL_MAX_BYTES threshold.
+func approxSize(d interface{}) int64 {
+	switch v := d.(type) {
+	case Request:
+		return int64(len(v.Body))
+	case Interaction:
+		return int64(len(v.Request.Body) + len(v.Response.Body))
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// sqsReceiveErrorBackoff bounds how fast runSQS retries after a
+// ReceiveMessageWithContext error, so a persistent failure (bad queue URL,
+// revoked IAM perms, throttling) doesn't turn into a tight busy loop.
+const sqsReceiveErrorBackoff = 5 * time.Second
+
+var (
+	replayObjectsFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_replay_objects_fetched_total",
+		Help: "Number of S3 objects fetched for replay.",
+	})
+	replayErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_replay_errors_total",
+		Help: "Number of errors encountered while replaying captured traffic.",
+	})
+	replayRequestsEmitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "traffic_collector_replay_requests_emitted_total",
+		Help: "Number of Request records re-emitted from replayed objects.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(replayObjectsFetched, replayErrors, replayRequestsEmitted)
+}
+
+// ReplayWorker consumes previously captured request bundles from S3, either
+// driven by SQS object-created notifications or by polling a bucket/prefix
+// on a fixed interval, and replays the contained Requests back through the
+// collector's normal processing pipeline.
+type ReplayWorker struct {
+	Collector *Collector
+	Logger    logrus.FieldLogger
+
+	SQSClient *sqs.SQS
+	S3Client  *s3.S3
+
+	QueueURL        string
+	PollBucket      string
+	PollPrefix      string
+	PollingInterval time.Duration
+
+	// UpstreamURL, when set, forwards replayed requests to an external
+	// collector instead of pushing them through processedRequestData.
+	UpstreamURL string
+
+	// seenKeys dedupes objects/records already replayed, bounded to
+	// maxSeenKeys with the oldest entries evicted FIFO so a worker left
+	// running indefinitely against a real archive bucket doesn't leak
+	// memory. seenOrder tracks insertion order for that eviction.
+	seenKeys   map[string]struct{}
+	seenOrder  []string
+	seenKeysMu sync.Mutex
+}
+
+// maxSeenKeys bounds ReplayWorker.seenKeys; see its doc comment.
+const maxSeenKeys = 10000
+
+// Run blocks, dispatching to SQS long-polling or plain bucket polling
+// depending on configuration, until ctx is cancelled.
+func (w *ReplayWorker) Run(ctx context.Context) {
+	if w.seenKeys == nil {
+		w.seenKeys = make(map[string]struct{})
+	}
+
+	if w.QueueURL != "" {
+		w.runSQS(ctx)
+		return
+	}
+	if w.PollBucket != "" {
+		w.runPoll(ctx)
+		return
+	}
+	w.Logger.Info("replay worker: no SQS_QUEUE_URL or POLL_BUCKET configured, not starting")
+}
+
+func (w *ReplayWorker) runSQS(ctx context.Context) {
+	w.Logger.Infof("replay worker: long-polling sqs queue %s", w.QueueURL)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		out, err := w.SQSClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(w.QueueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			replayErrors.Inc()
+			w.Logger.Warn(errors.Wrap(err, "receiving sqs messages"))
+			select {
+			case <-time.After(sqsReceiveErrorBackoff):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for _, msg := range out.Messages {
+			if err := w.handleSQSMessage(ctx, msg.Body); err != nil {
+				replayErrors.Inc()
+				w.Logger.Warn(errors.Wrap(err, "handling sqs message"))
+				continue
+			}
+
+			if _, err := w.SQSClient.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(w.QueueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			}); err != nil {
+				w.Logger.Warn(errors.Wrap(err, "deleting processed sqs message"))
+			}
+		}
+	}
+}
+
+func (w *ReplayWorker) handleSQSMessage(ctx context.Context, body *string) error {
+	if body == nil {
+		return nil
+	}
+
+	var s3Event events.S3Event
+	if err := json.Unmarshal([]byte(*body), &s3Event); err != nil {
+		return errors.Wrap(err, "decoding s3 event notification")
+	}
+
+	for _, record := range s3Event.Records {
+		bucket := record.S3.Bucket.Name
+		// S3 event notifications percent/+-encode the key; URLDecodedKey is
+		// the form that actually matches the object's real key.
+		key := record.S3.Object.URLDecodedKey
+		if err := w.replayObject(ctx, bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *ReplayWorker) runPoll(ctx context.Context) {
+	w.Logger.Infof("replay worker: polling s3://%s/%s every %s", w.PollBucket, w.PollPrefix, w.PollingInterval)
+	ticker := time.NewTicker(w.PollingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.pollOnce(ctx); err != nil {
+				replayErrors.Inc()
+				w.Logger.Warn(errors.Wrap(err, "polling bucket for new objects"))
+			}
+		}
+	}
+}
+
+func (w *ReplayWorker) pollOnce(ctx context.Context) error {
+	out, err := w.S3Client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(w.PollBucket),
+		Prefix: aws.String(w.PollPrefix),
+	})
+	if err != nil {
+		return errors.Wrap(err, "listing bucket objects")
+	}
+
+	for _, obj := range out.Contents {
+		key := aws.StringValue(obj.Key)
+		if w.alreadyProcessed(key) {
+			continue
+		}
+		if err := w.replayObject(ctx, w.PollBucket, key); err != nil {
+			// One bad object (corrupt JSON, a stray non-Request file under
+			// the prefix) shouldn't wedge every key listed after it, and
+			// since markProcessed is skipped it'll just be retried next
+			// tick — so log and move on to the rest of this listing.
+			replayErrors.Inc()
+			w.Logger.Warn(errors.Wrap(err, "replaying polled object"))
+			continue
+		}
+		w.markProcessed(key)
+	}
+	return nil
+}
+
+func (w *ReplayWorker) alreadyProcessed(key string) bool {
+	w.seenKeysMu.Lock()
+	defer w.seenKeysMu.Unlock()
+	_, ok := w.seenKeys[key]
+	return ok
+}
+
+func (w *ReplayWorker) markProcessed(key string) {
+	w.seenKeysMu.Lock()
+	defer w.seenKeysMu.Unlock()
+
+	if _, ok := w.seenKeys[key]; ok {
+		return
+	}
+	w.seenKeys[key] = struct{}{}
+	w.seenOrder = append(w.seenOrder, key)
+
+	if len(w.seenOrder) > maxSeenKeys {
+		oldest := w.seenOrder[0]
+		w.seenOrder = w.seenOrder[1:]
+		delete(w.seenKeys, oldest)
+	}
+}
+
+func (w *ReplayWorker) replayObject(ctx context.Context, bucket, key string) error {
+	if w.alreadyProcessed(fmt.Sprintf("%s/%s", bucket, key)) {
+		return nil
+	}
+
+	out, err := w.S3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.Wrap(err, "fetching replay object")
+	}
+	defer out.Body.Close()
+
+	var requests []Request
+	if err := json.NewDecoder(out.Body).Decode(&requests); err != nil {
+		return errors.Wrap(err, "decoding replay object")
+	}
+	replayObjectsFetched.Inc()
+
+	for _, r := range requests {
+		if w.UpstreamURL != "" {
+			if err := w.forwardRequest(r); err != nil {
+				return err
+			}
+		} else {
+			w.Collector.enqueue(r)
+		}
+		replayRequestsEmitted.Inc()
+	}
+
+	w.markProcessed(fmt.Sprintf("%s/%s", bucket, key))
+	return nil
+}
+
+func (w *ReplayWorker) forwardRequest(r Request) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "marshaling replayed request")
+	}
+
+	resp, err := http.Post(strings.TrimRight(w.UpstreamURL, "/")+r.Path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "forwarding replayed request upstream")
+	}
+	defer resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// OutputFormat selects how a flushed batch of Requests is encoded before
+// it's handed to Storage.
+type OutputFormat string
+
+const (
+	FormatJSON      OutputFormat = "json"
+	FormatNDJSON    OutputFormat = "ndjson"
+	FormatNDJSONGZ  OutputFormat = "ndjson.gz"
+	defaultRollMax               = maxRequests
+)
+
+// streamEncode writes requests to w in the given format, so it can be fed
+// directly into an io.Pipe feeding a streaming uploader. The NDJSON formats
+// are encoded record by record without holding the fully-encoded batch in
+// memory; FormatJSON marshals the whole batch in memory before writing it.
+func streamEncode(format OutputFormat, requests []interface{}, w io.Writer) error {
+	switch format {
+	case FormatNDJSON, FormatNDJSONGZ:
+		enc := w
+		var gz *gzip.Writer
+		if format == FormatNDJSONGZ {
+			gz = gzip.NewWriter(w)
+			enc = gz
+		}
+
+		jsonEnc := json.NewEncoder(enc)
+		for _, r := range requests {
+			if err := jsonEnc.Encode(r); err != nil {
+				return errors.Wrap(err, "encoding ndjson record")
+			}
+		}
+
+		if gz != nil {
+			if err := gz.Close(); err != nil {
+				return errors.Wrap(err, "closing gzip writer")
+			}
+		}
+		return nil
+
+	default: // FormatJSON
+		jsonData, err := json.MarshalIndent(requests, "", " ")
+		if err != nil {
+			return errors.Wrap(err, "marshaling request data")
+		}
+		_, err = w.Write(jsonData)
+		return err
+	}
+}
+
+// contentTypeFor and contentEncodingFor describe the object metadata for
+// a format; they don't depend on the actual encoded bytes so they can be
+// known up front, before streamEncode has written anything.
+func contentTypeFor(format OutputFormat) string {
+	switch format {
+	case FormatNDJSON, FormatNDJSONGZ:
+		return "application/x-ndjson"
+	default:
+		return "application/json"
+	}
+}
+
+func contentEncodingFor(format OutputFormat) string {
+	if format == FormatNDJSONGZ {
+		return "gzip"
+	}
+	return ""
+}
+
+func extensionFor(format OutputFormat) string {
+	switch format {
+	case FormatNDJSON:
+		return "ndjson"
+	case FormatNDJSONGZ:
+		return "ndjson.gz"
+	default:
+		return "json"
+	}
+}
+
+// hivePartitionedKey builds a Hive-style partitioned object key
+// (year=YYYY/month=MM/day=DD/hour=HH/<uuid>.<ext>) so downstream tools
+// like Athena or BigQuery can prune by prefix.
+func hivePartitionedKey(t time.Time, format OutputFormat) string {
+	return fmt.Sprintf(
+		"year=%s/month=%s/day=%s/hour=%s/%s.%s",
+		t.Format("2006"), t.Format("01"), t.Format("02"), t.Format("15"),
+		uuid.New().String(),
+		extensionFor(format),
+	)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Storage is the sink a Collector flushes captured traffic to. Drivers are
+// selected at startup by the STORAGE_BACKEND env var and registered with
+// registerStorageDriver, the same way keepstore registers its volume
+// drivers.
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string, opts ...PutOption) error
+}
+
+// PutOptions carries the handful of per-object knobs drivers may honor.
+// Not every driver uses every option (e.g. the file driver ignores
+// ContentEncoding).
+type PutOptions struct {
+	ContentEncoding string
+}
+
+// PutOption mutates PutOptions; used so Storage.Put can take optional,
+// driver-specific hints without growing a long positional arg list.
+type PutOption func(*PutOptions)
+
+// WithContentEncoding sets the Content-Encoding metadata on the written
+// object, e.g. "gzip" for gzip-compressed NDJSON batches.
+func WithContentEncoding(encoding string) PutOption {
+	return func(o *PutOptions) { o.ContentEncoding = encoding }
+}
+
+func applyPutOptions(opts []PutOption) PutOptions {
+	var o PutOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+type storageDriverFunc func(Environment, logrus.FieldLogger) (Storage, error)
+
+var storageDrivers = map[string]storageDriverFunc{}
+
+func registerStorageDriver(name string, fn storageDriverFunc) {
+	storageDrivers[name] = fn
+}
+
+// NewStorage builds the Storage backend named by env.StorageBackend.
+func NewStorage(env Environment, logger logrus.FieldLogger) (Storage, error) {
+	name := strings.ToLower(env.StorageBackend)
+	driver, ok := storageDrivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", env.StorageBackend)
+	}
+
+	storage, err := driver(env, logger)
+	if err != nil {
+		return nil, errors.Wrapf(err, "initializing %s storage backend", name)
+	}
+	return storage, nil
+}
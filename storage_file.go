@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	registerStorageDriver("file", newFileStorage)
+}
+
+// fileStorage writes captured traffic under a local directory, keyed by
+// the same object key the cloud drivers would use.
+type fileStorage struct {
+	dir string
+}
+
+func newFileStorage(env Environment, logger logrus.FieldLogger) (Storage, error) {
+	dir := env.FileDir
+	if dir == "" {
+		dir = "."
+	}
+	return &fileStorage{dir: dir}, nil
+}
+
+func (f *fileStorage) Put(ctx context.Context, key string, body io.Reader, contentType string, opts ...PutOption) error {
+	path := filepath.Join(f.dir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fileWriteErrorsTotal.Inc()
+		return errors.Wrap(err, "creating output directory")
+	}
+
+	out, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		fileWriteErrorsTotal.Inc()
+		return errors.Wrap(err, "opening file")
+	}
+	defer out.Close()
+
+	// Stream through a bufio.Writer rather than buffering the whole
+	// body in memory, mirroring the s3 driver's streaming uploader.
+	w := bufio.NewWriter(out)
+	if _, err := io.Copy(w, body); err != nil {
+		fileWriteErrorsTotal.Inc()
+		return errors.Wrap(err, "writing to file")
+	}
+	if err := w.Flush(); err != nil {
+		fileWriteErrorsTotal.Inc()
+		return errors.Wrap(err, "flushing file writer")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	registerStorageDriver("gcs", newGCSStorage)
+}
+
+// gcsStorage writes captured traffic to a Google Cloud Storage bucket.
+type gcsStorage struct {
+	client *storage.Client
+	bucket string
+
+	// per-object knobs, see Environment.GCSStorageClass/GCSKMSKeyName.
+	storageClass string
+	kmsKeyName   string
+}
+
+func newGCSStorage(env Environment, logger logrus.FieldLogger) (Storage, error) {
+	if env.GCSBucket == "" {
+		return nil, errors.New("GCS_BUCKET must be set for the gcs storage backend")
+	}
+
+	var opts []option.ClientOption
+	if env.GCSCredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(env.GCSCredentialsFile))
+	}
+
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating gcs client")
+	}
+
+	return &gcsStorage{
+		client:       client,
+		bucket:       env.GCSBucket,
+		storageClass: env.GCSStorageClass,
+		kmsKeyName:   env.GCSKMSKeyName,
+	}, nil
+}
+
+func (g *gcsStorage) Put(ctx context.Context, key string, body io.Reader, contentType string, opts ...PutOption) error {
+	options := applyPutOptions(opts)
+
+	w := g.client.Bucket(g.bucket).Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.ContentEncoding = options.ContentEncoding
+	if g.storageClass != "" {
+		w.StorageClass = g.storageClass
+	}
+	if g.kmsKeyName != "" {
+		w.KMSKeyName = g.kmsKeyName
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		w.Close()
+		return errors.Wrap(err, "writing gcs object")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "closing gcs object")
+	}
+	return nil
+}
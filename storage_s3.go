@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultS3PartSizeMB         = 5
+	defaultS3UploadConcurrency  = 5
+	defaultS3MaxRetries         = 3
+	defaultS3MaxInflightUploads = 4
+)
+
+func init() {
+	registerStorageDriver("s3", newS3Storage)
+}
+
+// s3Storage writes to AWS S3 or any S3-compatible endpoint (MinIO,
+// SeaweedFS, ...) when AWS_S3_ENDPOINT is set, streaming the body through
+// s3manager.Uploader so large capture batches don't need to be buffered
+// into memory before the put. Each part of a multipart upload is
+// buffered and retried independently by the SDK's request retryer
+// (configured via cfg.WithMaxRetries below), which is what lets this
+// stay safe for a non-seekable, single-pass io.Reader body.
+type s3Storage struct {
+	uploader *s3manager.Uploader
+	bucket   string
+	acl      string
+
+	// per-object knobs, see Environment.S3SSE/S3SSEKMSKeyID/S3StorageClass.
+	storageClass string
+	sse          string
+	sseKMSKeyID  string
+
+	// inflight bounds the number of concurrent multipart uploads so a
+	// burst of flushes can't open unbounded connections to S3.
+	inflight chan struct{}
+}
+
+func newS3Storage(env Environment, logger logrus.FieldLogger) (Storage, error) {
+	if env.S3Bucket == "" {
+		return nil, errors.New("S3_BUCKET must be set for the s3 storage backend")
+	}
+
+	maxRetries := env.S3MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultS3MaxRetries
+	}
+
+	cfg := aws.NewConfig().WithMaxRetries(maxRetries)
+	if env.AWSS3Region != "" {
+		cfg = cfg.WithRegion(env.AWSS3Region)
+	} else if env.AWSRegion != "" {
+		cfg = cfg.WithRegion(env.AWSRegion)
+	}
+
+	if env.AWSS3Endpoint != "" {
+		cfg = cfg.
+			WithEndpoint(env.AWSS3Endpoint).
+			WithS3ForcePathStyle(env.AWSS3ForcePathStyle)
+	}
+
+	if env.AWSS3AccessKey != "" || env.AWSS3SecretKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(env.AWSS3AccessKey, env.AWSS3SecretKey, ""))
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating aws session")
+	}
+
+	partSizeMB := env.S3PartSizeMB
+	if partSizeMB <= 0 {
+		partSizeMB = defaultS3PartSizeMB
+	}
+	concurrency := env.S3UploadConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultS3UploadConcurrency
+	}
+	maxInflight := env.S3MaxInflightUploads
+	if maxInflight <= 0 {
+		maxInflight = defaultS3MaxInflightUploads
+	}
+
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = int64(partSizeMB) * 1024 * 1024
+		u.Concurrency = concurrency
+	})
+
+	acl := env.S3ACL
+	if acl == "" {
+		acl = "private"
+	}
+
+	return &s3Storage{
+		uploader:     uploader,
+		bucket:       env.S3Bucket,
+		acl:          acl,
+		storageClass: env.S3StorageClass,
+		sse:          env.S3SSE,
+		sseKMSKeyID:  env.S3SSEKMSKeyID,
+		inflight:     make(chan struct{}, maxInflight),
+	}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, body io.Reader, contentType string, opts ...PutOption) error {
+	options := applyPutOptions(opts)
+
+	select {
+	case s.inflight <- struct{}{}:
+		defer func() { <-s.inflight }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	input := &s3manager.UploadInput{
+		ACL:         aws.String(s.acl),
+		Bucket:      aws.String(s.bucket),
+		Body:        body,
+		ContentType: aws.String(contentType),
+		Key:         aws.String(key),
+	}
+	if options.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(options.ContentEncoding)
+	}
+	if s.storageClass != "" {
+		input.StorageClass = aws.String(s.storageClass)
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+		if s.sseKMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(s.sseKMSKeyID)
+		}
+	}
+
+	start := time.Now()
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	s3PutLatencySeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		s3ErrorsTotal.WithLabelValues(s3ErrorCode(err)).Inc()
+		return errors.Wrap(err, "s3 multipart upload")
+	}
+	return nil
+}
+
+func s3ErrorCode(err error) string {
+	if awsErr, ok := errors.Cause(err).(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "unknown"
+}